@@ -0,0 +1,115 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads and validates influx-spout's TOML configuration
+// file, shared by the listener, filter and writer components.
+package config
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds every setting influx-spout's components read out of
+// their TOML configuration file. Not every field is relevant to every
+// component - the writer, for instance, ignores the listener/filter
+// specific rule settings.
+type Config struct {
+	Name  string `toml:"name"`
+	Mode  string `toml:"mode"`
+	Debug bool   `toml:"debug"`
+
+	// NATS
+	NATSAddress        string   `toml:"nats_address"`
+	NATSSubject        []string `toml:"nats_subject"`
+	NATSSubjectMonitor string   `toml:"nats_subject_monitor"`
+	NATSPendingMaxMB   int      `toml:"nats_pending_max_mb"`
+
+	// InfluxDB v1 write API (the historical, and still default, output)
+	InfluxDBAddress string `toml:"influxdb_address"`
+	InfluxDBPort    int    `toml:"influxdb_port"`
+	DBName          string `toml:"dbname"`
+
+	// Batching
+	BatchMessages int `toml:"batch_messages"`
+	BatchMaxMB    int `toml:"batch_max_mb"`
+	BatchMaxSecs  int `toml:"batch_max_secs"`
+
+	Workers          int `toml:"workers"`
+	WriteTimeoutSecs int `toml:"write_timeout_secs"`
+
+	// Output selection. Outputs names one or more of "influxdb", "kafka",
+	// "mqtt", "file" or "stdout"; more than one fans the same batch out
+	// to every named output. An empty list preserves the historical
+	// default of writing to InfluxDB over HTTP alone.
+	Outputs []string `toml:"output"`
+
+	KafkaBrokers []string `toml:"kafka_brokers"`
+	KafkaTopic   string   `toml:"kafka_topic"`
+
+	MQTTBrokerURL string `toml:"mqtt_broker_url"`
+	MQTTTopic     string `toml:"mqtt_topic"`
+	MQTTQoS       int    `toml:"mqtt_qos"`
+
+	OutputFilePath     string `toml:"output_file_path"`
+	OutputFileMaxBytes int64  `toml:"output_file_max_bytes"`
+
+	// Retry / dead-letter / disk spool, used when a write to Outputs
+	// fails. Zero-valued retry timing fields (initial, max, multiplier)
+	// fall back to defaults applied by the writer package itself. A
+	// WriteMaxRetries of 0 disables retries, an empty dead letter
+	// subject or SpoolDir disables that step, and a SpoolMaxMB of 0
+	// leaves the spool unbounded.
+	WriteMaxRetries      int     `toml:"write_max_retries"`
+	WriteRetryInitialMS  int     `toml:"write_retry_initial_ms"`
+	WriteRetryMaxMS      int     `toml:"write_retry_max_ms"`
+	WriteRetryMultiplier float64 `toml:"write_retry_multiplier"`
+
+	NATSSubjectDeadLetter string `toml:"nats_subject_dead_letter"`
+	SpoolDir              string `toml:"spool_dir"`
+	SpoolMaxMB            int    `toml:"spool_max_mb"`
+
+	// InfluxDB v2 write API. InfluxDBVersion defaults to the v1 /write
+	// API when unset or 1; set to 2 to switch to /api/v2/write with
+	// token auth.
+	InfluxDBVersion int    `toml:"influxdb_version"`
+	InfluxDBOrg     string `toml:"influxdb_org"`
+	InfluxDBBucket  string `toml:"influxdb_bucket"`
+	InfluxDBToken   string `toml:"influxdb_token"`
+	Precision       string `toml:"precision"`
+	Compress        bool   `toml:"compress"`
+
+	// Probes / graceful shutdown
+	ProbePort                  int     `toml:"probe_port"`
+	PprofPort                  int     `toml:"pprof_port"`
+	ShutdownDrainTimeoutSecs   int     `toml:"shutdown_drain_timeout_secs"`
+	WriteSuccessRatioThreshold float64 `toml:"write_success_ratio_threshold"`
+
+	// Horizontal scaling: queue-group sharding across writer replicas,
+	// and optional client-side hash partitioning of line-protocol lines
+	// by measurement/tag-set. NumPartitions <= 1 disables partitioning.
+	NATSQueueGroup string   `toml:"nats_queue_group"`
+	NumPartitions  int      `toml:"num_partitions"`
+	PartitionKey   []string `toml:"partition_key"`
+}
+
+// FromTOML reads and validates a Config from the TOML file at path.
+func FromTOML(path string) (*Config, error) {
+	c := new(Config)
+	if _, err := toml.DecodeFile(path, c); err != nil {
+		return nil, fmt.Errorf("failed to load config file %q: %v", path, err)
+	}
+	return c, nil
+}
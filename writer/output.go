@@ -0,0 +1,485 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+// Output is the destination a Writer ships batches to. Implementations
+// are free to do whatever is needed to get a batch to its backend; the
+// batching, filtering and monitoring carried out by the Writer do not
+// change based on which Output is in use.
+type Output interface {
+	// Write ships a single batch. It is called from a worker goroutine
+	// and may block.
+	Write(batch []byte) error
+
+	// Name identifies the output, for logging and metrics labelling.
+	Name() string
+
+	// Close releases any resources held by the output.
+	Close() error
+}
+
+// NewOutput builds the Output(s) configured in c. When more than one
+// output is configured, the returned Output fans the batch out to all
+// of them, failing if any one of them fails.
+func NewOutput(c *config.Config) (Output, error) {
+	kinds := c.Outputs
+	if len(kinds) == 0 {
+		// Preserve the historical default: write to InfluxDB over HTTP.
+		kinds = []string{"influxdb"}
+	}
+
+	outputs := make([]Output, 0, len(kinds))
+	for _, kind := range kinds {
+		out, err := newOutput(kind, c)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, out)
+	}
+
+	if len(outputs) == 1 {
+		return outputs[0], nil
+	}
+	return &fanOutOutput{outputs: outputs}, nil
+}
+
+func newOutput(kind string, c *config.Config) (Output, error) {
+	switch kind {
+	case "influxdb", "":
+		return newInfluxDBOutput(c), nil
+	case "kafka":
+		return newKafkaOutput(c)
+	case "mqtt":
+		return newMQTTOutput(c)
+	case "file":
+		return newFileOutput(c)
+	case "stdout":
+		return newStdoutOutput(c), nil
+	default:
+		return nil, fmt.Errorf("unknown output type: %q", kind)
+	}
+}
+
+// fanOutOutput mirrors a batch to every configured output.
+type fanOutOutput struct {
+	outputs []Output
+}
+
+func (f *fanOutOutput) Write(batch []byte) error {
+	var firstErr error
+	for _, out := range f.outputs {
+		if err := out.Write(batch); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", out.Name(), err)
+		}
+	}
+	return firstErr
+}
+
+func (f *fanOutOutput) Name() string {
+	return "fanout"
+}
+
+func (f *fanOutOutput) Close() error {
+	var firstErr error
+	for _, out := range f.outputs {
+		if err := out.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// influxDBOutput posts batches to an InfluxDB HTTP write endpoint,
+// either the v1 `/write` API (the original, and still default,
+// behaviour) or the v2 `/api/v2/write` API.
+type influxDBOutput struct {
+	url      string
+	pingURL  string
+	token    string
+	compress bool
+	client   *http.Client
+	gzPool   sync.Pool
+}
+
+func newInfluxDBOutput(c *config.Config) *influxDBOutput {
+	base := fmt.Sprintf("http://%s:%d", c.InfluxDBAddress, c.InfluxDBPort)
+
+	var url, token string
+	if c.InfluxDBVersion == 2 {
+		url = fmt.Sprintf("%s/api/v2/write?org=%s&bucket=%s&precision=%s",
+			base, c.InfluxDBOrg, c.InfluxDBBucket, c.Precision)
+		token = c.InfluxDBToken
+	} else {
+		url = fmt.Sprintf("%s/write?db=%s", base, c.DBName)
+	}
+
+	return &influxDBOutput{
+		url:      url,
+		pingURL:  base + "/ping",
+		token:    token,
+		compress: c.Compress,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:       10,
+				IdleConnTimeout:    30 * time.Second,
+				DisableCompression: true,
+			},
+			Timeout: time.Duration(c.WriteTimeoutSecs) * time.Second,
+		},
+		gzPool: sync.Pool{
+			New: func() interface{} { return gzip.NewWriter(ioutil.Discard) },
+		},
+	}
+}
+
+func (o *influxDBOutput) Write(batch []byte) error {
+	body := bytes.NewReader(batch)
+
+	req, err := http.NewRequest(http.MethodPost, o.url, body)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.token != "" {
+		req.Header.Set("Authorization", "Token "+o.token)
+	}
+
+	if o.compress {
+		compressed, err := o.gzipBatch(batch)
+		if err != nil {
+			return fmt.Errorf("failed to gzip batch: %v", err)
+		}
+		req.Body = ioutil.NopCloser(compressed)
+		req.ContentLength = int64(compressed.Len())
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		// Network-level failures (timeouts, connection refused, etc)
+		// are always worth retrying.
+		return &RetryableError{Err: fmt.Errorf("failed to send HTTP request: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		errText := fmt.Sprintf("received HTTP %v from %v", resp.Status, o.url)
+		if msg := o.readErrorBody(resp); msg != "" {
+			errText += fmt.Sprintf("\nresponse body: %s\n", msg)
+		}
+		err := errors.New(errText)
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return &RetryableError{Err: err, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		// Other 4xx responses indicate the batch itself is bad and
+		// retrying verbatim won't help.
+		return err
+	}
+	return nil
+}
+
+// gzipBatch compresses batch using a pooled gzip.Writer to avoid
+// allocating one per request under load.
+func (o *influxDBOutput) gzipBatch(batch []byte) (*bytes.Buffer, error) {
+	gz := o.gzPool.Get().(*gzip.Writer)
+	defer o.gzPool.Put(gz)
+
+	var buf bytes.Buffer
+	gz.Reset(&buf)
+	if _, err := gz.Write(batch); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// influxV2Error is the JSON error body returned by the InfluxDB v2
+// write API, e.g. {"code":"invalid","message":"unable to parse..."}.
+type influxV2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// readErrorBody returns a human-readable description of a failed
+// response body, parsing it as a v2 JSON error when possible.
+func (o *influxDBOutput) readErrorBody(resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+
+	var v2err influxV2Error
+	if json.Unmarshal(body, &v2err) == nil && v2err.Message != "" {
+		return fmt.Sprintf("%s: %s", v2err.Code, v2err.Message)
+	}
+	return string(body)
+}
+
+// parseRetryAfter parses the value of a "Retry-After" response header,
+// which may be expressed either as a number of seconds or as an HTTP
+// date. A zero duration is returned if the header is absent or
+// unparseable, leaving the caller's own backoff in charge.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (o *influxDBOutput) Name() string { return "influxdb" }
+func (o *influxDBOutput) Close() error { return nil }
+
+// Ping checks that the InfluxDB server is reachable, without writing
+// any data. It satisfies the Pinger interface used for readiness
+// checks.
+func (o *influxDBOutput) Ping() error {
+	resp, err := o.client.Get(o.pingURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("received HTTP %v from %v", resp.Status, o.pingURL)
+	}
+	return nil
+}
+
+// kafkaOutput publishes batches as a single message to a Kafka topic.
+type kafkaOutput struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func newKafkaOutput(c *config.Config) (*kafkaOutput, error) {
+	if len(c.KafkaBrokers) == 0 {
+		return nil, fmt.Errorf("kafka output requires kafka_brokers to be set")
+	}
+	if c.KafkaTopic == "" {
+		return nil, fmt.Errorf("kafka output requires kafka_topic to be set")
+	}
+
+	conf := sarama.NewConfig()
+	conf.Producer.RequiredAcks = sarama.WaitForLocal
+	conf.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(c.KafkaBrokers, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to kafka: %v", err)
+	}
+
+	return &kafkaOutput{topic: c.KafkaTopic, producer: producer}, nil
+}
+
+func (o *kafkaOutput) Write(batch []byte) error {
+	_, _, err := o.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: o.topic,
+		Value: sarama.ByteEncoder(batch),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send to kafka: %v", err)
+	}
+	return nil
+}
+
+func (o *kafkaOutput) Name() string { return "kafka" }
+func (o *kafkaOutput) Close() error { return o.producer.Close() }
+
+// mqttOutput publishes batches as a single retained-off message on an
+// MQTT topic.
+type mqttOutput struct {
+	topic string
+	qos   byte
+	cli   mqtt.Client
+}
+
+func newMQTTOutput(c *config.Config) (*mqttOutput, error) {
+	if c.MQTTBrokerURL == "" {
+		return nil, fmt.Errorf("mqtt output requires mqtt_broker_url to be set")
+	}
+	if c.MQTTTopic == "" {
+		return nil, fmt.Errorf("mqtt output requires mqtt_topic to be set")
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(c.MQTTBrokerURL)
+	cli := mqtt.NewClient(opts)
+	if token := cli.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to mqtt broker: %v", token.Error())
+	}
+
+	return &mqttOutput{topic: c.MQTTTopic, qos: byte(c.MQTTQoS), cli: cli}, nil
+}
+
+func (o *mqttOutput) Write(batch []byte) error {
+	token := o.cli.Publish(o.topic, o.qos, false, batch)
+	if token.Wait(); token.Error() != nil {
+		return fmt.Errorf("failed to publish to mqtt: %v", token.Error())
+	}
+	return nil
+}
+
+func (o *mqttOutput) Name() string { return "mqtt" }
+func (o *mqttOutput) Close() error {
+	o.cli.Disconnect(250)
+	return nil
+}
+
+// defaultFileOutputMaxBytes is the rotation threshold used when
+// OutputFileMaxBytes isn't set in the config.
+const defaultFileOutputMaxBytes = 100 * 1024 * 1024
+
+// fileOutput appends batches to a local file, flushing after every
+// write so data survives a crash. Once the file reaches maxBytes it is
+// rotated out of the way (renamed with a timestamp suffix) and writing
+// continues on a fresh file at path, so a long-running writer doesn't
+// leave a single ever-growing file behind.
+type fileOutput struct {
+	path     string
+	maxBytes int64
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	curSize int64
+}
+
+func newFileOutput(c *config.Config) (*fileOutput, error) {
+	if c.OutputFilePath == "" {
+		return nil, fmt.Errorf("file output requires output_file_path to be set")
+	}
+
+	maxBytes := c.OutputFileMaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultFileOutputMaxBytes
+	}
+
+	o := &fileOutput{path: c.OutputFilePath, maxBytes: maxBytes}
+	if err := o.openLocked(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *fileOutput) openLocked() error {
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat output file: %v", err)
+	}
+
+	o.f = f
+	o.w = bufio.NewWriter(f)
+	o.curSize = info.Size()
+	return nil
+}
+
+// rotateLocked closes and renames the current output file out of the
+// way, then opens a fresh file at the original path.
+func (o *fileOutput) rotateLocked() error {
+	if err := o.w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush output file before rotation: %v", err)
+	}
+	if err := o.f.Close(); err != nil {
+		return fmt.Errorf("failed to close output file before rotation: %v", err)
+	}
+
+	rotated := fmt.Sprintf("%s.%s", o.path, time.Now().Format("20060102T150405.000000000"))
+	if err := os.Rename(o.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate output file: %v", err)
+	}
+
+	return o.openLocked()
+}
+
+func (o *fileOutput) Write(batch []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.maxBytes > 0 && o.curSize >= o.maxBytes {
+		if err := o.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := o.w.Write(batch)
+	if err != nil {
+		return fmt.Errorf("failed to write batch to file: %v", err)
+	}
+	if err := o.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write batch to file: %v", err)
+	}
+	o.curSize += int64(n)
+	return nil
+}
+
+func (o *fileOutput) Name() string { return "file" }
+func (o *fileOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+// stdoutOutput writes batches to the writer process' standard output,
+// mostly useful for debugging and local testing.
+type stdoutOutput struct {
+	w *bufio.Writer
+}
+
+func newStdoutOutput(c *config.Config) *stdoutOutput {
+	return &stdoutOutput{w: bufio.NewWriter(os.Stdout)}
+}
+
+func (o *stdoutOutput) Write(batch []byte) error {
+	if _, err := o.w.Write(batch); err != nil {
+		return err
+	}
+	return o.w.Flush()
+}
+
+func (o *stdoutOutput) Name() string { return "stdout" }
+func (o *stdoutOutput) Close() error { return nil }
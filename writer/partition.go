@@ -0,0 +1,104 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sync"
+)
+
+// partitionedBatch is one of a writer's internal batches when
+// client-side partitioning is enabled. batch is replaced wholesale
+// (rather than reset in place) when it is handed off for sending, so
+// mu only needs to be held for the duration of a single line write or
+// batch swap.
+type partitionedBatch struct {
+	mu    sync.Mutex
+	batch *batchBuffer
+}
+
+// splitKeySection returns the measurement+tag-set portion of a single
+// line-protocol line, i.e. everything up to the first unescaped
+// space.
+func splitKeySection(line []byte) []byte {
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' && (i == 0 || line[i-1] != '\\') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitUnescaped splits b on sep, ignoring any sep preceded by a
+// backslash escape.
+func splitUnescaped(b []byte, sep byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] == sep && (i == 0 || b[i-1] != '\\') {
+			parts = append(parts, b[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, b[start:])
+}
+
+// partitionKey extracts the bytes used to hash-route line to a
+// partition. keys selects which fields make up the key: "measurement"
+// refers to the measurement name, anything else is looked up as a tag
+// name. An empty keys hashes on the measurement name alone.
+func partitionKey(line []byte, keys []string) []byte {
+	tokens := splitUnescaped(splitKeySection(line), ',')
+	if len(tokens) == 0 {
+		return nil
+	}
+	measurement := tokens[0]
+
+	if len(keys) == 0 {
+		return measurement
+	}
+
+	tags := make(map[string][]byte, len(tokens)-1)
+	for _, tok := range tokens[1:] {
+		kv := splitUnescaped(tok, '=')
+		if len(kv) == 2 {
+			tags[string(kv[0])] = kv[1]
+		}
+	}
+
+	var key bytes.Buffer
+	for _, k := range keys {
+		if k == "measurement" {
+			key.Write(measurement)
+		} else {
+			key.Write(tags[k])
+		}
+		key.WriteByte(0)
+	}
+	return key.Bytes()
+}
+
+// partitionIndex hashes line onto one of n partitions using
+// partitionKey(line, keys), so that lines belonging to the same
+// series are always routed to the same partition.
+func partitionIndex(line []byte, keys []string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(partitionKey(line, keys))
+	return int(h.Sum32() % uint32(n))
+}
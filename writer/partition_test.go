@@ -0,0 +1,117 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitKeySection(t *testing.T) {
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"cpu,host=a value=1 1000", "cpu,host=a"},
+		{`cpu,host=a\ b value=1 1000`, `cpu,host=a\ b`},
+		{"cpu", "cpu"}, // no unescaped space: whole line
+	}
+
+	for _, c := range cases {
+		got := splitKeySection([]byte(c.line))
+		if !bytes.Equal(got, []byte(c.want)) {
+			t.Errorf("splitKeySection(%q) = %q, want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestSplitUnescaped(t *testing.T) {
+	cases := []struct {
+		in   string
+		sep  byte
+		want []string
+	}{
+		{"a,b,c", ',', []string{"a", "b", "c"}},
+		{`a\,b,c`, ',', []string{`a\,b`, "c"}},
+		{"solo", ',', []string{"solo"}},
+		{"", ',', []string{""}},
+	}
+
+	for _, c := range cases {
+		got := splitUnescaped([]byte(c.in), c.sep)
+		if len(got) != len(c.want) {
+			t.Fatalf("splitUnescaped(%q, %q) = %q, want %q", c.in, c.sep, got, c.want)
+		}
+		for i := range c.want {
+			if !bytes.Equal(got[i], []byte(c.want[i])) {
+				t.Errorf("splitUnescaped(%q, %q)[%d] = %q, want %q", c.in, c.sep, i, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	line := []byte("cpu,host=a,region=us value=1 1000")
+
+	if got, want := partitionKey(line, nil), "cpu"; string(got) != want {
+		t.Errorf("partitionKey(nil) = %q, want %q", got, want)
+	}
+
+	got := partitionKey(line, []string{"measurement", "host"})
+	want := "cpu\x00a\x00"
+	if string(got) != want {
+		t.Errorf("partitionKey([measurement,host]) = %q, want %q", got, want)
+	}
+
+	// A tag that isn't present on the line contributes an empty segment
+	// rather than erroring.
+	got = partitionKey(line, []string{"missing"})
+	if want := "\x00"; string(got) != want {
+		t.Errorf("partitionKey([missing]) = %q, want %q", got, want)
+	}
+}
+
+func TestPartitionIndexIsStableForSameSeries(t *testing.T) {
+	keys := []string{"measurement", "host"}
+	lineA := []byte("cpu,host=a,region=us value=1 1000")
+	lineA2 := []byte("cpu,host=a,region=eu value=2 2000")
+	lineB := []byte("cpu,host=b value=3 3000")
+
+	const n = 8
+	idxA := partitionIndex(lineA, keys, n)
+	idxA2 := partitionIndex(lineA2, keys, n)
+	if idxA != idxA2 {
+		t.Errorf("lines for the same host hashed to different partitions: %d vs %d", idxA, idxA2)
+	}
+
+	if idx := partitionIndex(lineA, keys, n); idx < 0 || idx >= n {
+		t.Errorf("partitionIndex returned out-of-range index %d for n=%d", idx, n)
+	}
+
+	// Not a strict requirement, but with a reasonable hash these two
+	// distinct keys shouldn't usually collide - document the behavior
+	// rather than assert it, since a collision wouldn't be a bug.
+	_ = partitionIndex(lineB, keys, n)
+}
+
+func TestPartitionIndexSinglePartition(t *testing.T) {
+	line := []byte("cpu,host=a value=1 1000")
+	if idx := partitionIndex(line, nil, 1); idx != 0 {
+		t.Errorf("partitionIndex with n=1 = %d, want 0", idx)
+	}
+	if idx := partitionIndex(line, nil, 0); idx != 0 {
+		t.Errorf("partitionIndex with n=0 = %d, want 0", idx)
+	}
+}
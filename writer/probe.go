@@ -0,0 +1,178 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultProbePort            = 8081
+	defaultPprofPort            = 8080
+	defaultShutdownDrainTimeout = 5 * time.Second
+	writeRatioCheckInterval     = 5 * time.Second
+)
+
+// Pinger is implemented by Outputs that can be health-checked
+// independently of writing a real batch (e.g. hitting InfluxDB's
+// `/ping` endpoint). Outputs that don't implement it are assumed
+// always reachable as far as readiness is concerned.
+type Pinger interface {
+	Ping() error
+}
+
+// startPprofServer serves the process-wide pprof handlers (registered
+// on http.DefaultServeMux via the net/http/pprof side-effect import)
+// on a configurable port, replacing the previous hard-coded :8080.
+func (w *Writer) startPprofServer() {
+	port := w.c.PprofPort
+	if port == 0 {
+		port = defaultPprofPort
+	}
+	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+}
+
+// startProbeServer serves Kubernetes-style /healthz and /readyz
+// endpoints on a configurable port. /healthz reports the process is
+// up; /readyz reports whether the writer is currently able to make
+// progress.
+func (w *Writer) startProbeServer() {
+	port := w.c.ProbePort
+	if port == 0 {
+		port = defaultProbePort
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&w.ready) == 1 {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	w.probeSrv = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	go func() {
+		if err := w.probeSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error: probe server failed: %v", err)
+		}
+	}()
+}
+
+// checkInitialReadiness is run once NATS subscriptions are set up and
+// flushed. It additionally pings the output (when supported) so the
+// writer doesn't report ready until InfluxDB itself is reachable.
+func (w *Writer) checkInitialReadiness() error {
+	if pinger, ok := w.output.(Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			return fmt.Errorf("output not reachable: %v", err)
+		}
+	}
+	atomic.StoreInt32(&w.ready, 1)
+	return nil
+}
+
+// monitorReadiness keeps readiness in sync with NATS connectivity and
+// the recent ratio of successful writes, flipping back to not-ready
+// when either looks unhealthy. A window with no write activity at all
+// doesn't get a free pass: the output must still answer a fresh Ping
+// (when it supports one) before readiness is granted, so a writer
+// whose initial probe failed and that nothing has tried to write to
+// since doesn't silently become ready just because it's been quiet.
+func (w *Writer) monitorReadiness() {
+	defer w.wg.Done()
+
+	threshold := w.c.WriteSuccessRatioThreshold
+	if threshold <= 0 {
+		threshold = 0.5
+	}
+
+	for {
+		select {
+		case <-time.After(writeRatioCheckInterval):
+		case <-w.stop:
+			return
+		}
+
+		atomic.StoreInt32(&w.ready, boolToInt32(w.checkReadiness(threshold)))
+	}
+}
+
+// checkReadiness reports whether the writer should currently be
+// considered ready: NATS must be connected, and the output must be
+// confirmed reachable per writeHealthy.
+func (w *Writer) checkReadiness(threshold float64) bool {
+	if !w.nc.IsConnected() {
+		return false
+	}
+	return w.writeHealthy(threshold)
+}
+
+// writeHealthy reports whether the output looks reachable, either by a
+// recent write success ratio at or above threshold, or - when no
+// writes were attempted this window - a fresh Ping. Nothing was
+// written and the output can't be pinged directly: leave readiness as
+// it already was rather than assuming the absence of failures means
+// the output is reachable.
+func (w *Writer) writeHealthy(threshold float64) bool {
+	ratio, hadActivity := w.recentWriteSuccessRatio()
+	if hadActivity {
+		return ratio >= threshold
+	}
+
+	if pinger, ok := w.output.(Pinger); ok {
+		return pinger.Ping() == nil
+	}
+
+	return atomic.LoadInt32(&w.ready) == 1
+}
+
+// recentWriteSuccessRatio returns the fraction of writes that
+// succeeded since the last call and whether any writes were attempted
+// at all, resetting the counters for the next window.
+func (w *Writer) recentWriteSuccessRatio() (ratio float64, hadActivity bool) {
+	ok := atomic.SwapInt64(&w.recentWriteOK, 0)
+	failed := atomic.SwapInt64(&w.recentWriteFailed, 0)
+	total := ok + failed
+	if total == 0 {
+		return 0, false
+	}
+	return float64(ok) / float64(total), true
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// stopProbeServer shuts the probe HTTP server down, bounded by ctx.
+func (w *Writer) stopProbeServer(ctx context.Context) {
+	if w.probeSrv == nil {
+		return
+	}
+	if err := w.probeSrv.Shutdown(ctx); err != nil {
+		log.Printf("Error: failed to shut down probe server: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// pingableOutput is a minimal Output that also implements Pinger, so
+// tests can control whether the simulated backend is reachable.
+type pingableOutput struct {
+	pingErr error
+}
+
+func (o *pingableOutput) Write([]byte) error { return nil }
+func (o *pingableOutput) Name() string       { return "fake" }
+func (o *pingableOutput) Close() error       { return nil }
+func (o *pingableOutput) Ping() error        { return o.pingErr }
+
+// unpingableOutput is an Output that does not implement Pinger.
+type unpingableOutput struct{}
+
+func (o *unpingableOutput) Write([]byte) error { return nil }
+func (o *unpingableOutput) Name() string       { return "fake" }
+func (o *unpingableOutput) Close() error       { return nil }
+
+func TestRecentWriteSuccessRatio(t *testing.T) {
+	w := &Writer{}
+
+	if ratio, hadActivity := w.recentWriteSuccessRatio(); hadActivity || ratio != 0 {
+		t.Errorf("got (%v, %v) with no writes, want (0, false)", ratio, hadActivity)
+	}
+
+	atomic.AddInt64(&w.recentWriteOK, 3)
+	atomic.AddInt64(&w.recentWriteFailed, 1)
+	ratio, hadActivity := w.recentWriteSuccessRatio()
+	if !hadActivity {
+		t.Fatal("hadActivity = false, want true after writes were recorded")
+	}
+	if want := 0.75; ratio != want {
+		t.Errorf("got ratio %v, want %v", ratio, want)
+	}
+
+	// The counters reset after being read.
+	if _, hadActivity := w.recentWriteSuccessRatio(); hadActivity {
+		t.Error("hadActivity = true on second call, want false (counters should have reset)")
+	}
+}
+
+func TestWriteHealthyUsesRatioWhenThereWasActivity(t *testing.T) {
+	w := &Writer{output: &unpingableOutput{}}
+	atomic.AddInt64(&w.recentWriteOK, 1)
+	atomic.AddInt64(&w.recentWriteFailed, 1)
+
+	if healthy := w.writeHealthy(0.6); healthy {
+		t.Error("writeHealthy(0.6) = true with a 50% success ratio, want false")
+	}
+}
+
+func TestWriteHealthyPingsWhenNoActivity(t *testing.T) {
+	w := &Writer{output: &pingableOutput{pingErr: nil}}
+	if !w.writeHealthy(0.5) {
+		t.Error("writeHealthy = false with no activity and a successful Ping, want true")
+	}
+
+	w = &Writer{output: &pingableOutput{pingErr: errors.New("unreachable")}}
+	if w.writeHealthy(0.5) {
+		t.Error("writeHealthy = true with no activity and a failing Ping, want false")
+	}
+}
+
+func TestWriteHealthyKeepsPriorStateWithoutPinger(t *testing.T) {
+	w := &Writer{output: &unpingableOutput{}}
+	atomic.StoreInt32(&w.ready, 0)
+	if w.writeHealthy(0.5) {
+		t.Error("writeHealthy = true for a not-yet-ready writer with no activity and no Pinger, want false")
+	}
+
+	atomic.StoreInt32(&w.ready, 1)
+	if !w.writeHealthy(0.5) {
+		t.Error("writeHealthy = false for an already-ready writer with no activity and no Pinger, want true")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+// retryPolicy captures the exponential backoff settings used when a
+// write to an Output fails transiently.
+type retryPolicy struct {
+	maxRetries int
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+}
+
+func retryPolicyFromConfig(c *config.Config) retryPolicy {
+	p := retryPolicy{
+		maxRetries: c.WriteMaxRetries,
+		initial:    time.Duration(c.WriteRetryInitialMS) * time.Millisecond,
+		max:        time.Duration(c.WriteRetryMaxMS) * time.Millisecond,
+		multiplier: c.WriteRetryMultiplier,
+	}
+	if p.initial <= 0 {
+		p.initial = 500 * time.Millisecond
+	}
+	if p.max <= 0 {
+		p.max = 30 * time.Second
+	}
+	if p.multiplier <= 1 {
+		p.multiplier = 2
+	}
+	return p
+}
+
+// backoff returns how long to wait before retry attempt n (0-based),
+// with up to 20% jitter applied to avoid thundering-herd retries.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.initial)
+	for i := 0; i < attempt; i++ {
+		d *= p.multiplier
+		if d >= float64(p.max) {
+			d = float64(p.max)
+			break
+		}
+	}
+
+	jitter := d * 0.2 * rand.Float64()
+	return time.Duration(d + jitter)
+}
+
+// RetryableError marks a write failure as transient, optionally
+// carrying a server-requested delay (e.g. from a "Retry-After"
+// header) before the next attempt should be made.
+type RetryableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
@@ -0,0 +1,108 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+func TestRetryPolicyFromConfigDefaults(t *testing.T) {
+	p := retryPolicyFromConfig(&config.Config{})
+
+	if p.initial != 500*time.Millisecond {
+		t.Errorf("got initial %v, want default of 500ms", p.initial)
+	}
+	if p.max != 30*time.Second {
+		t.Errorf("got max %v, want default of 30s", p.max)
+	}
+	if p.multiplier != 2 {
+		t.Errorf("got multiplier %v, want default of 2", p.multiplier)
+	}
+}
+
+func TestRetryPolicyFromConfigOverrides(t *testing.T) {
+	p := retryPolicyFromConfig(&config.Config{
+		WriteMaxRetries:      5,
+		WriteRetryInitialMS:  100,
+		WriteRetryMaxMS:      1000,
+		WriteRetryMultiplier: 3,
+	})
+
+	if p.maxRetries != 5 {
+		t.Errorf("got maxRetries %d, want 5", p.maxRetries)
+	}
+	if p.initial != 100*time.Millisecond {
+		t.Errorf("got initial %v, want 100ms", p.initial)
+	}
+	if p.max != 1000*time.Millisecond {
+		t.Errorf("got max %v, want 1000ms", p.max)
+	}
+	if p.multiplier != 3 {
+		t.Errorf("got multiplier %v, want 3", p.multiplier)
+	}
+}
+
+func TestRetryPolicyBackoffGrowsAndCaps(t *testing.T) {
+	p := retryPolicy{initial: 100 * time.Millisecond, max: 1 * time.Second, multiplier: 2}
+
+	// With up to 20% jitter, backoff(n) should fall in
+	// [base, base*1.2] where base is the uncapped exponential value,
+	// clamped to p.max.
+	cases := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, 1 * time.Second}, // capped at max
+		{10, 1 * time.Second},
+	}
+
+	for _, c := range cases {
+		d := p.backoff(c.attempt)
+		if d < c.base || d > c.base+c.base/5 {
+			t.Errorf("attempt %d: backoff %v out of expected range [%v, %v]",
+				c.attempt, d, c.base, c.base+c.base/5)
+		}
+	}
+}
+
+func TestRetryableErrorUnwraps(t *testing.T) {
+	cause := errors.New("boom")
+	err := &RetryableError{Err: cause, RetryAfter: time.Second}
+
+	if err.Error() != "boom" {
+		t.Errorf("got Error() %q, want %q", err.Error(), "boom")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is(err, cause) = false, want true")
+	}
+
+	wrapped := fmt.Errorf("output: %w", err)
+	var retryable *RetryableError
+	if !errors.As(wrapped, &retryable) {
+		t.Fatal("errors.As failed to find *RetryableError through a wrapped error")
+	}
+	if retryable.RetryAfter != time.Second {
+		t.Errorf("got RetryAfter %v, want 1s", retryable.RetryAfter)
+	}
+}
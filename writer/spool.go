@@ -0,0 +1,278 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// diskSpool is a bounded, segmented on-disk queue used to hold batches
+// that could not be written (or dead-lettered) immediately, so they
+// aren't lost across a writer restart. Segments are plain files of
+// length-prefixed records; a full segment is closed and a new one
+// started once it reaches segmentMaxBytes.
+type diskSpool struct {
+	dir             string
+	maxBytes        int64
+	segmentMaxBytes int64
+
+	mu            sync.Mutex
+	size          int64
+	segments      []string
+	nextSegmentID int64
+	cur           *os.File
+	curSize       int64
+
+	// offsets records, per segment path, how far a previous Drain call
+	// got before fn returned an error - so a retry resumes after the
+	// batches that already succeeded instead of replaying them.
+	offsets map[string]int64
+}
+
+const spoolSegmentMaxBytes = 16 * 1024 * 1024
+
+func newDiskSpool(dir string, maxBytes int64) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	s := &diskSpool{dir: dir, maxBytes: maxBytes, segmentMaxBytes: spoolSegmentMaxBytes}
+
+	entries, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list existing spool segments: %v", err)
+	}
+	sort.Strings(entries)
+	for _, path := range entries {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, path)
+		s.size += info.Size()
+
+		if id, ok := segmentID(path); ok && id >= s.nextSegmentID {
+			s.nextSegmentID = id + 1
+		}
+	}
+
+	return s, nil
+}
+
+// segmentID extracts the numeric segment id encoded in a spool
+// segment's filename.
+func segmentID(path string) (int64, bool) {
+	name := strings.TrimSuffix(filepath.Base(path), ".spool")
+	id, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// Close closes the segment currently being appended to.
+func (s *diskSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return nil
+	}
+	return s.cur.Close()
+}
+
+// Size returns the total number of bytes currently spooled to disk.
+func (s *diskSpool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Write appends a batch to the spool, fsync'ing it before returning so
+// the batch survives a crash. Once maxBytes is exceeded, the oldest
+// spooled data is dropped to make room.
+func (s *diskSpool) Write(batch []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cur == nil || s.curSize >= s.segmentMaxBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(batch)))
+	if _, err := s.cur.Write(lenBuf[:]); err != nil {
+		return fmt.Errorf("failed to write to spool: %v", err)
+	}
+	if _, err := s.cur.Write(batch); err != nil {
+		return fmt.Errorf("failed to write to spool: %v", err)
+	}
+	if err := s.cur.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync spool: %v", err)
+	}
+
+	n := int64(len(lenBuf) + len(batch))
+	s.curSize += n
+	s.size += n
+
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.segments) > 1 {
+		s.dropOldestLocked()
+	}
+
+	return nil
+}
+
+// rotateLocked closes the current segment (if any) and opens a new
+// one, numbered with a monotonically increasing id so a freshly
+// created segment never reuses a path still referenced in
+// s.segments, even after earlier segments have been dropped or fully
+// drained.
+func (s *diskSpool) rotateLocked() error {
+	if s.cur != nil {
+		s.cur.Close()
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.spool", s.nextSegmentID))
+	s.nextSegmentID++
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %v", err)
+	}
+
+	s.cur = f
+	s.curSize = 0
+	s.segments = append(s.segments, path)
+	return nil
+}
+
+func (s *diskSpool) dropOldestLocked() {
+	oldest := s.segments[0]
+	if info, err := os.Stat(oldest); err == nil {
+		s.size -= info.Size()
+	}
+	os.Remove(oldest)
+	delete(s.offsets, oldest)
+	s.segments = s.segments[1:]
+}
+
+// Drain replays every spooled batch, oldest first, passing each to fn.
+// A segment is removed once every batch in it has been successfully
+// handed to fn; draining stops at the first error so a redelivery
+// failure doesn't lose data, and resumes after the batches that
+// already succeeded on the next call rather than replaying them.
+//
+// The segment currently being appended to is rotated out first (if it
+// holds any data), so batches that were spooled since the last drain
+// become drainable on this call instead of waiting for segmentMaxBytes
+// to be reached - which, at low spool volume, could otherwise never
+// happen.
+func (s *diskSpool) Drain(fn func([]byte) error) error {
+	s.mu.Lock()
+	if s.cur != nil && s.curSize > 0 {
+		if err := s.rotateLocked(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	segments := append([]string(nil), s.segments...)
+	s.mu.Unlock()
+
+	// Never drain the last segment - it's still being appended to.
+	if len(segments) > 0 {
+		segments = segments[:len(segments)-1]
+	}
+
+	for _, path := range segments {
+		if err := s.drainSegment(path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diskSpool) drainSegment(path string, fn func([]byte) error) error {
+	s.mu.Lock()
+	offset := s.offsets[path]
+	s.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open spool segment %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek spool segment %s: %v", path, err)
+		}
+	}
+	pos := offset
+
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(f, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("corrupt spool segment %s: %v", path, err)
+		}
+
+		recLen := binary.BigEndian.Uint32(lenBuf[:])
+		batch := make([]byte, recLen)
+		if _, err := io.ReadFull(f, batch); err != nil {
+			return fmt.Errorf("corrupt spool segment %s: %v", path, err)
+		}
+
+		if err := fn(batch); err != nil {
+			s.mu.Lock()
+			if s.offsets == nil {
+				s.offsets = make(map[string]int64)
+			}
+			s.offsets[path] = pos
+			s.mu.Unlock()
+			return err
+		}
+
+		pos += int64(len(lenBuf)) + int64(recLen)
+	}
+
+	s.mu.Lock()
+	delete(s.offsets, path)
+	for i, seg := range s.segments {
+		if seg == path {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	s.mu.Unlock()
+
+	return os.Remove(path)
+}
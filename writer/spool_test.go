@@ -0,0 +1,182 @@
+// Copyright 2017 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDiskSpoolRotateAndDrain(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("newDiskSpool failed: %v", err)
+	}
+	s.segmentMaxBytes = 1 // force a new segment on every write
+
+	batches := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, b := range batches {
+		if err := s.Write(b); err != nil {
+			t.Fatalf("Write(%q) failed: %v", b, err)
+		}
+	}
+
+	if got, want := len(s.segments), len(batches); got != want {
+		t.Fatalf("got %d segments, want %d (one per write)", got, want)
+	}
+
+	var got [][]byte
+	err = s.Drain(func(batch []byte) error {
+		got = append(got, append([]byte(nil), batch...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	// The segment still being appended to is rotated out at the start
+	// of Drain (if non-empty), so every previously-written batch comes
+	// back - draining isn't stuck waiting for segmentMaxBytes.
+	want := batches
+	if len(got) != len(want) {
+		t.Fatalf("got %d batches, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("batch %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if got, want := len(s.segments), 1; got != want {
+		t.Fatalf("got %d segments remaining after drain, want %d", got, want)
+	}
+}
+
+func TestDiskSpoolRotateNeverReusesPath(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("newDiskSpool failed: %v", err)
+	}
+	s.segmentMaxBytes = 1 // force a new segment on every write
+
+	write := func(data string) {
+		t.Helper()
+		if err := s.Write([]byte(data)); err != nil {
+			t.Fatalf("Write(%q) failed: %v", data, err)
+		}
+	}
+	drain := func() {
+		t.Helper()
+		if err := s.Drain(func([]byte) error { return nil }); err != nil {
+			t.Fatalf("Drain failed: %v", err)
+		}
+	}
+
+	write("a")
+	write("b")
+	drain() // rotates out "b"'s segment, drains "a" and "b", leaves a fresh empty live segment
+	write("c")
+	write("d")
+
+	seen := make(map[string]bool)
+	for _, path := range s.segments {
+		if seen[path] {
+			t.Fatalf("segment path %q used by more than one live segment: %v", path, s.segments)
+		}
+		seen[path] = true
+	}
+}
+
+func TestDiskSpoolDrainResumesAfterPartialFailure(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("newDiskSpool failed: %v", err)
+	}
+
+	for _, b := range [][]byte{[]byte("one"), []byte("two"), []byte("three")} {
+		if err := s.Write(b); err != nil {
+			t.Fatalf("Write(%q) failed: %v", b, err)
+		}
+	}
+	// Force the segment holding all three batches to be drainable by
+	// rotating onto a new (empty) one.
+	s.mu.Lock()
+	if err := s.rotateLocked(); err != nil {
+		s.mu.Unlock()
+		t.Fatalf("rotateLocked failed: %v", err)
+	}
+	s.mu.Unlock()
+
+	failOn := "two"
+	var firstPass [][]byte
+	err = s.Drain(func(batch []byte) error {
+		firstPass = append(firstPass, append([]byte(nil), batch...))
+		if string(batch) == failOn {
+			return errors.New("simulated delivery failure")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected Drain to return the simulated failure")
+	}
+	if want := [][]byte{[]byte("one"), []byte("two")}; !batchesEqual(firstPass, want) {
+		t.Fatalf("first pass delivered %q, want %q", firstPass, want)
+	}
+
+	var secondPass [][]byte
+	err = s.Drain(func(batch []byte) error {
+		secondPass = append(secondPass, append([]byte(nil), batch...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("second Drain failed: %v", err)
+	}
+	// "one" already succeeded on the first pass and must not be
+	// redelivered; draining should resume with "two" and "three".
+	if want := [][]byte{[]byte("two"), []byte("three")}; !batchesEqual(secondPass, want) {
+		t.Fatalf("second pass delivered %q, want %q", secondPass, want)
+	}
+}
+
+func TestDiskSpoolEvictsOldestOverCapacity(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 6) // room for one one-byte batch plus its 4-byte header
+	if err != nil {
+		t.Fatalf("newDiskSpool failed: %v", err)
+	}
+	s.segmentMaxBytes = 1 // one batch per segment, so eviction has whole segments to drop
+
+	for _, b := range [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")} {
+		if err := s.Write(b); err != nil {
+			t.Fatalf("Write(%q) failed: %v", b, err)
+		}
+	}
+
+	if s.size > s.maxBytes && len(s.segments) > 1 {
+		t.Fatalf("spool size %d still exceeds maxBytes %d with %d segments left",
+			s.size, s.maxBytes, len(s.segments))
+	}
+}
+
+func batchesEqual(got, want [][]byte) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
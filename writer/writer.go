@@ -18,12 +18,14 @@ package writer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"net/http"
@@ -42,11 +44,19 @@ const (
 	statWriteRequests = "write_requests"
 	statFailedWrites  = "failed_writes"
 	statMaxPending    = "max_pending"
+	statRetries       = "retries"
+	statRetrySuccess  = "retry_success"
+	statDeadLettered  = "dead_lettered"
+	statSpoolBytes    = "spool_bytes"
+
+	statQueueGroupPending = "queue_group_pending"
 )
 
 type Writer struct {
 	c             *config.Config
-	url           string
+	output        Output
+	retryPolicy   retryPolicy
+	spool         *diskSpool
 	batchMaxBytes int
 	batchMaxAge   time.Duration
 	nc            *nats.Conn
@@ -54,26 +64,65 @@ type Writer struct {
 	stats         *stats.Stats
 	wg            sync.WaitGroup
 	stop          chan struct{}
+
+	probeSrv             *http.Server
+	shutdownDrainTimeout time.Duration
+	ready                int32 // accessed atomically; see monitorReadiness
+	recentWriteOK        int64 // accessed atomically
+	recentWriteFailed    int64 // accessed atomically
+
+	numPartitions int
+	partitions    []*partitionedBatch
 }
 
 // StartWriter is the heavylifter, subscribes to the subject where
-// listeners publish the messages and writes it the InfluxDB endpoint.
+// listeners publish the messages and ships it to the configured
+// output(s) (InfluxDB by default).
 func StartWriter(c *config.Config) (_ *Writer, err error) {
+	shutdownDrainTimeout := defaultShutdownDrainTimeout
+	if c.ShutdownDrainTimeoutSecs > 0 {
+		shutdownDrainTimeout = time.Duration(c.ShutdownDrainTimeoutSecs) * time.Second
+	}
+
 	w := &Writer{
-		c:             c,
-		url:           fmt.Sprintf("http://%s:%d/write?db=%s", c.InfluxDBAddress, c.InfluxDBPort, c.DBName),
-		batchMaxBytes: c.BatchMaxMB * 1024 * 1024,
-		batchMaxAge:   time.Duration(c.BatchMaxSecs) * time.Second,
-		stats:         stats.New(statReceived, statWriteRequests, statFailedWrites, statMaxPending),
+		c:                    c,
+		retryPolicy:          retryPolicyFromConfig(c),
+		shutdownDrainTimeout: shutdownDrainTimeout,
+		batchMaxBytes:        c.BatchMaxMB * 1024 * 1024,
+		batchMaxAge:          time.Duration(c.BatchMaxSecs) * time.Second,
+		stats: stats.New(statReceived, statWriteRequests, statFailedWrites, statMaxPending,
+			statRetries, statRetrySuccess, statDeadLettered, statSpoolBytes, statQueueGroupPending),
+		numPartitions: c.NumPartitions,
 		stop:          make(chan struct{}),
 	}
+
+	if w.numPartitions > 0 {
+		w.partitions = make([]*partitionedBatch, w.numPartitions)
+		for i := range w.partitions {
+			w.partitions[i] = &partitionedBatch{batch: newBatchBuffer()}
+		}
+	}
 	defer func() {
 		if err != nil {
 			w.Stop()
 		}
 	}()
 
-	go http.ListenAndServe(":8080", nil) // for pprof profiling
+	w.startPprofServer()
+	w.startProbeServer()
+
+	w.output, err = NewOutput(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output: %v", err)
+	}
+
+	if c.SpoolDir != "" {
+		w.spool, err = newDiskSpool(c.SpoolDir, int64(c.SpoolMaxMB)*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk spool: %v", err)
+		}
+		w.stats.Max(statSpoolBytes, int(w.spool.Size()))
+	}
 
 	w.rules, err = filter.RuleSetFromConfig(c)
 	if err != nil {
@@ -97,12 +146,27 @@ func StartWriter(c *config.Config) (_ *Writer, err error) {
 		go w.worker(jobs)
 	}
 
-	// subscribe this writer to the NATS subject.
+	if w.numPartitions > 0 {
+		w.wg.Add(w.numPartitions)
+		for idx := 0; idx < w.numPartitions; idx++ {
+			go w.partitionSender(idx)
+		}
+	}
+
+	// subscribe this writer to the NATS subject. When a queue group is
+	// configured, multiple writer replicas cooperatively consume the
+	// subject without duplication.
 	maxPendingBytes := c.NATSPendingMaxMB * 1024 * 1024
+	handler := func(msg *nats.Msg) {
+		jobs <- msg
+	}
 	for _, subject := range c.NATSSubject {
-		sub, err := w.nc.Subscribe(subject, func(msg *nats.Msg) {
-			jobs <- msg
-		})
+		var sub *nats.Subscription
+		if c.NATSQueueGroup != "" {
+			sub, err = w.nc.QueueSubscribe(subject, c.NATSQueueGroup, handler)
+		} else {
+			sub, err = w.nc.Subscribe(subject, handler)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("subscription for %q failed: %v", subject, err)
 		}
@@ -123,6 +187,17 @@ func StartWriter(c *config.Config) (_ *Writer, err error) {
 	w.wg.Add(1)
 	go w.startStatistician()
 
+	if w.spool != nil {
+		w.wg.Add(1)
+		go w.drainSpool()
+	}
+
+	if err := w.checkInitialReadiness(); err != nil {
+		log.Printf("Warning: writer not ready yet: %v", err)
+	}
+	w.wg.Add(1)
+	go w.monitorReadiness()
+
 	log.Printf("writer subscribed to [%v] at %s with %d workers",
 		c.NATSSubject, c.NATSAddress, c.Workers)
 	log.Printf("POST timeout: %ds", c.WriteTimeoutSecs)
@@ -135,24 +210,44 @@ func StartWriter(c *config.Config) (_ *Writer, err error) {
 // connection to NATS. It will be block until all Writer goroutines
 // have stopped.
 func (w *Writer) Stop() {
+	atomic.StoreInt32(&w.ready, 0)
 	close(w.stop)
 	w.wg.Wait()
 	if w.nc != nil {
 		w.nc.Close()
 	}
+	if w.output != nil {
+		if err := w.output.Close(); err != nil {
+			log.Printf("Error: failed to close output %q: %v", w.output.Name(), err)
+		}
+	}
+	if w.spool != nil {
+		if err := w.spool.Close(); err != nil {
+			log.Printf("Error: failed to close disk spool: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.shutdownDrainTimeout)
+	defer cancel()
+	w.stopProbeServer(ctx)
 }
 
 func (w *Writer) worker(jobs <-chan *nats.Msg) {
 	defer w.wg.Done()
 
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Duration(w.c.WriteTimeoutSecs) * time.Second,
+	if w.numPartitions > 0 {
+		// Partitioning is enabled - batching and sending is handled by
+		// the partitionSender goroutines instead, this worker only
+		// routes incoming lines to the right partition.
+		for {
+			select {
+			case j := <-jobs:
+				w.stats.Inc(statReceived)
+				w.routeToPartitions(j.Data)
+			case <-w.stop:
+				return
+			}
+		}
 	}
 
 	batch := newBatchBuffer()
@@ -165,13 +260,14 @@ func (w *Writer) worker(jobs <-chan *nats.Msg) {
 		case <-time.After(time.Second):
 			// Wake up regularly to check batch age
 		case <-w.stop:
+			w.flushOnShutdown(batch)
 			return
 		}
 
 		if w.shouldSendBatch(batch) {
 			w.stats.Inc(statWriteRequests)
 
-			if err := w.sendBatch(batch, client); err != nil {
+			if err := w.sendBatch(batch); err != nil {
 				w.stats.Inc(statFailedWrites)
 				log.Printf("Error: %v", err)
 			}
@@ -182,6 +278,119 @@ func (w *Writer) worker(jobs <-chan *nats.Msg) {
 	}
 }
 
+// routeToPartitions splits data into lines, applies the configured
+// filter rules (if any) and hash-routes each surviving line to its
+// partition's batch, keyed by w.c.PartitionKey.
+func (w *Writer) routeToPartitions(data []byte) {
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if w.rules.Count() > 0 && !w.filterLine(line) {
+			continue
+		}
+
+		idx := partitionIndex(line, w.c.PartitionKey, w.numPartitions)
+		p := w.partitions[idx]
+
+		p.mu.Lock()
+		if err := p.batch.Write(line); err != nil {
+			log.Printf("Error: %v", err)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// partitionSender owns partition idx's batch lifecycle: it wakes up
+// regularly to check whether the batch is due to be sent, swapping in
+// a fresh batch before sending so routeToPartitions is never blocked
+// on network I/O.
+func (w *Writer) partitionSender(idx int) {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-time.After(time.Second):
+			w.maybeSendPartition(idx)
+		case <-w.stop:
+			w.flushPartitionOnShutdown(idx)
+			return
+		}
+	}
+}
+
+func (w *Writer) maybeSendPartition(idx int) {
+	p := w.partitions[idx]
+
+	p.mu.Lock()
+	if !w.shouldSendBatch(p.batch) {
+		p.mu.Unlock()
+		return
+	}
+	toSend := p.batch
+	p.batch = newBatchBuffer()
+	p.mu.Unlock()
+
+	w.stats.Inc(statWriteRequests)
+	if err := w.sendBatch(toSend); err != nil {
+		w.stats.Inc(statFailedWrites)
+		log.Printf("Error: %v", err)
+	}
+}
+
+// flushPartitionOnShutdown makes a bounded best-effort attempt to send
+// partition idx's buffered batch when the writer is stopped.
+func (w *Writer) flushPartitionOnShutdown(idx int) {
+	p := w.partitions[idx]
+
+	p.mu.Lock()
+	if p.batch.Writes() == 0 {
+		p.mu.Unlock()
+		return
+	}
+	toSend := p.batch
+	p.batch = newBatchBuffer()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := w.sendBatch(toSend); err != nil {
+			log.Printf("Error: failed to flush partition %d batch during shutdown: %v", idx, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(w.shutdownDrainTimeout):
+		log.Printf("Warning: shutdown drain timed out after %v for partition %d, buffered batch may be lost",
+			w.shutdownDrainTimeout, idx)
+	}
+}
+
+// flushOnShutdown makes a bounded best-effort attempt to send any
+// batch still buffered in a worker when the writer is stopped, so a
+// pod terminated by Kubernetes doesn't lose in-flight data.
+func (w *Writer) flushOnShutdown(batch *batchBuffer) {
+	if batch.Writes() == 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := w.sendBatch(batch); err != nil {
+			log.Printf("Error: failed to flush batch during shutdown: %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(w.shutdownDrainTimeout):
+		log.Printf("Warning: shutdown drain timed out after %v, buffered batch may be lost", w.shutdownDrainTimeout)
+	}
+}
+
 func (w *Writer) getBatchWriteFunc(batch *batchBuffer) func([]byte) {
 	batchWrite := func(data []byte) {
 		if err := batch.Write(data); err != nil {
@@ -219,26 +428,109 @@ func (w *Writer) shouldSendBatch(batch *batchBuffer) bool {
 		batch.Age() >= w.batchMaxAge
 }
 
-// sendBatch sends the accumulated batch via HTTP to InfluxDB.
-func (w *Writer) sendBatch(batch *batchBuffer, client *http.Client) error {
-	resp, err := client.Post(w.url, "application/json; charset=UTF-8", batch.Data())
+// sendBatch ships the accumulated batch to the writer's output(s),
+// retrying transient failures with exponential backoff. Once retries
+// are exhausted, or the failure is permanent, the batch is handed to
+// deadLetter, which publishes and/or spools it only where a dead letter
+// subject or spool directory is configured.
+func (w *Writer) sendBatch(batch *batchBuffer) error {
+	data, err := ioutil.ReadAll(batch.Data())
 	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %v\n", err)
+		return fmt.Errorf("failed to read batch: %v", err)
+	}
+
+	err = w.writeWithRetry(data)
+	if err == nil {
+		return nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode > 300 {
-		errText := fmt.Sprintf("received HTTP %v from %v", resp.Status, w.url)
-		if w.c.Debug {
-			body, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				errText += fmt.Sprintf("\nresponse body: %s\n", body)
+	w.deadLetter(data, err)
+	return fmt.Errorf("failed to write batch to %s, dead-lettered: %v", w.output.Name(), err)
+}
+
+// writeWithRetry attempts to write data to the output, retrying
+// RetryableError failures with exponential backoff up to
+// retryPolicy.maxRetries times.
+func (w *Writer) writeWithRetry(data []byte) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = w.output.Write(data)
+		if err == nil {
+			atomic.AddInt64(&w.recentWriteOK, 1)
+			if attempt > 0 {
+				w.stats.Inc(statRetrySuccess)
 			}
+			return nil
+		}
+
+		var retryable *RetryableError
+		if !errors.As(err, &retryable) || attempt >= w.retryPolicy.maxRetries {
+			atomic.AddInt64(&w.recentWriteFailed, 1)
+			return err
+		}
+
+		delay := retryable.RetryAfter
+		if delay <= 0 {
+			delay = w.retryPolicy.backoff(attempt)
+		}
+
+		w.stats.Inc(statRetries)
+		log.Printf("Warning: write to %s failed (attempt %d/%d), retrying in %v: %v",
+			w.output.Name(), attempt+1, w.retryPolicy.maxRetries, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return err
 		}
-		return errors.New(errText)
 	}
+}
 
-	return nil
+// deadLetter publishes a batch that could not be written to the
+// configured dead letter subject (if any) and spools it to disk (if
+// enabled) so it isn't lost while the output is unavailable.
+func (w *Writer) deadLetter(data []byte, cause error) {
+	w.stats.Inc(statDeadLettered)
+	log.Printf("Warning: dead-lettering batch (%d bytes): %v", len(data), cause)
+
+	if w.c.NATSSubjectDeadLetter != "" {
+		if err := w.nc.Publish(w.c.NATSSubjectDeadLetter, data); err != nil {
+			log.Printf("Error: failed to publish to dead letter subject %q: %v",
+				w.c.NATSSubjectDeadLetter, err)
+		}
+	}
+
+	if w.spool != nil {
+		if err := w.spool.Write(data); err != nil {
+			log.Printf("Error: failed to spool batch to disk: %v", err)
+		} else {
+			w.stats.Max(statSpoolBytes, int(w.spool.Size()))
+		}
+	}
+}
+
+// drainSpool periodically attempts to replay spooled batches back
+// through the output, so data queued while it was unavailable is
+// delivered once it recovers.
+func (w *Writer) drainSpool() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-time.After(10 * time.Second):
+		case <-w.stop:
+			return
+		}
+
+		err := w.spool.Drain(func(batch []byte) error {
+			return w.writeWithRetry(batch)
+		})
+		if err != nil {
+			log.Printf("Warning: spool drain paused, output still unavailable: %v", err)
+			continue
+		}
+		w.stats.Max(statSpoolBytes, int(w.spool.Size()))
+	}
 }
 
 func (w *Writer) signalDrop(subject string, drop, last int) {
@@ -270,6 +562,12 @@ func (w *Writer) monitorSub(sub *nats.Subscription) {
 		}
 		w.stats.Max(statMaxPending, maxBytes)
 
+		if w.c.NATSQueueGroup != "" {
+			if pendingMsgs, _, err := sub.Pending(); err == nil {
+				w.stats.Max(statQueueGroupPending, pendingMsgs)
+			}
+		}
+
 		drop, err = sub.Dropped()
 		if err != nil {
 			log.Printf("NATS warning: failed to get the number of dropped message from NATS: %v\n", err)
@@ -300,6 +598,10 @@ func (w *Writer) startStatistician() {
 		lines := stats.SnapshotToPrometheus(w.stats.Snapshot(), time.Now(), labels)
 		w.nc.Publish(w.c.NATSSubjectMonitor, lines)
 
+		if w.numPartitions > 0 {
+			w.publishPartitionMetrics(labels)
+		}
+
 		select {
 		case <-time.After(3 * time.Second):
 		case <-w.stop:
@@ -308,6 +610,27 @@ func (w *Writer) startStatistician() {
 	}
 }
 
+// publishPartitionMetrics emits batch_size and batch_age_seconds
+// gauges for every partition, labelled by partition index.
+func (w *Writer) publishPartitionMetrics(labels map[string]string) {
+	now := time.Now()
+	for idx, p := range w.partitions {
+		p.mu.Lock()
+		size := p.batch.Size()
+		age := p.batch.Age()
+		p.mu.Unlock()
+
+		pLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			pLabels[k] = v
+		}
+		pLabels["partition"] = strconv.Itoa(idx)
+
+		w.nc.Publish(w.c.NATSSubjectMonitor, stats.CounterToPrometheus("batch_size", size, now, pLabels))
+		w.nc.Publish(w.c.NATSSubjectMonitor, stats.CounterToPrometheus("batch_age_seconds", int(age.Seconds()), now, pLabels))
+	}
+}
+
 func (w *Writer) metricsLabels() map[string]string {
 	return map[string]string{
 		"component":        "writer",